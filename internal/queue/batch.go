@@ -0,0 +1,128 @@
+package queue
+
+// Batching support: when several pending recipients of the same item
+// are headed to the same remote domain, we can deliver to all of them
+// in a single SMTP transaction (one MAIL FROM / DATA, followed by
+// multiple RCPT TO) instead of opening one connection per recipient.
+// This cuts bandwidth and connection count considerably for list
+// traffic, at the cost of requiring courier support.
+
+import (
+	"fmt"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/log"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// Result is the outcome of a single recipient's delivery within a batch.
+type Result struct {
+	Rcpt      string
+	Err       error
+	Permanent bool
+}
+
+// BatchCourier is implemented by couriers that can deliver a message to
+// several recipients within a single transaction. Couriers that don't
+// implement it are only ever used one recipient at a time.
+//
+// This is an opt-in extension point on courier.Courier: the queue type-
+// asserts for it at dispatch time (see dispatchDue), rather than adding
+// a required method to the Courier interface, so couriers that don't
+// implement it keep working unchanged. No courier in this tree
+// implements it yet, so batching doesn't engage until the SMTP courier
+// (outside this package) grows a DeliverBatch method.
+type BatchCourier interface {
+	DeliverBatch(from string, rcpts []string, data []byte) ([]Result, error)
+}
+
+// dispatchBatch delivers item to every recipient in group in a single
+// transaction via batchC, and records the per-recipient results.
+// Every recipient in group belongs to the same item and the same
+// destination domain.
+func (q *Queue) dispatchBatch(batchC BatchCourier, group []*Recipient, domain string) {
+	// dispatchDue acquired one throttle slot and marked one in-flight
+	// entry per recipient in group (it doesn't know they'll end up
+	// batched together), so we must release/finish one per recipient
+	// too, not just once for the whole batch.
+	defer func() {
+		for _, rcpt := range group {
+			q.throttle.release(domain)
+			q.inFlight.finish(rcpt.ID)
+		}
+	}()
+
+	item, err := q.store.LoadItem(group[0].ItemID)
+	if err != nil {
+		log.Errorf("scheduler: error loading item %q: %v", group[0].ItemID, err)
+		return
+	}
+
+	tr := trace.New("Queue.DispatchBatch", item.ID)
+	defer tr.Finish()
+
+	if time.Since(item.CreatedAt) >= q.retry.get(domain).MaxLifetime {
+		q.finalize(tr, item, true)
+		return
+	}
+
+	// Recipients we've already delivered to very recently (most likely
+	// because we crashed between the courier accepting the message and
+	// us persisting Recipient_SENT) don't need to go through the courier
+	// again; everyone else goes in the actual batch.
+	keys := map[string]string{}
+	var toSend []*Recipient
+	var addrs []string
+	for _, rcpt := range group {
+		key := sendKey(item.From, []string{rcpt.Address}, item.Data)
+		if q.sendRecorder.Seen(key) {
+			tr.Printf("%s already sent recently, not re-delivering", rcpt.Address)
+			item.recordResult(tr, q, rcpt, nil, false)
+			continue
+		}
+		keys[rcpt.Address] = key
+		toSend = append(toSend, rcpt)
+		addrs = append(addrs, rcpt.Address)
+	}
+
+	if len(toSend) == 0 {
+		q.checkFinalize(tr, item)
+		return
+	}
+
+	tr.Debugf("sending batch of %d to %s", len(addrs), domain)
+	start := time.Now()
+	results, err := batchC.DeliverBatch(item.From, addrs, item.Data)
+	if err != nil {
+		// The whole transaction failed (e.g. we couldn't even connect);
+		// treat it as a temporary failure for every recipient in the
+		// batch.
+		tr.Errorf("batch delivery to %s failed: %v", domain, err)
+		for _, rcpt := range toSend {
+			deliverAttempts.Add("email:remote", 1)
+			recordDeliveryMetrics("remote", domain, start, err, false)
+			item.recordResult(tr, q, rcpt, err, false)
+		}
+	} else {
+		byAddr := map[string]Result{}
+		for _, r := range results {
+			byAddr[r.Rcpt] = r
+		}
+		for _, rcpt := range toSend {
+			r, ok := byAddr[rcpt.Address]
+			rErr, permanent := r.Err, r.Permanent
+			if !ok {
+				rErr, permanent = fmt.Errorf("no result returned for %q", rcpt.Address), false
+			}
+
+			deliverAttempts.Add("email:remote", 1)
+			recordDeliveryMetrics("remote", domain, start, rErr, permanent)
+			if rErr == nil {
+				q.sendRecorder.Record(keys[rcpt.Address], item.ID)
+			}
+			item.recordResult(tr, q, rcpt, rErr, permanent)
+		}
+	}
+
+	q.checkFinalize(tr, item)
+}
@@ -0,0 +1,144 @@
+package queue
+
+// This file builds RFC 3464 delivery status notifications (failure
+// bounces, delay notices, and RFC 3461 NOTIFY=SUCCESS receipts),
+// honoring the DSN parameters recorded on the item and its recipients
+// (NOTIFY, ORCPT, ENVID, RET).
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// dsnKind identifies what kind of DSN we're building.
+type dsnKind int
+
+const (
+	dsnFailure dsnKind = iota
+	dsnDelay
+	dsnSuccess
+)
+
+func (k dsnKind) action() string {
+	switch k {
+	case dsnDelay:
+		return "delayed"
+	case dsnSuccess:
+		return "delivered"
+	default:
+		return "failed"
+	}
+}
+
+func (k dsnKind) statusCode() string {
+	switch k {
+	case dsnDelay:
+		return "4.0.0"
+	case dsnSuccess:
+		return "2.0.0"
+	default:
+		return "5.0.0"
+	}
+}
+
+func (k dsnKind) subject() string {
+	switch k {
+	case dsnDelay:
+		return "Delayed Mail (still being retried)"
+	case dsnSuccess:
+		return "Successful Mail Delivery Report"
+	default:
+		return "Undelivered Mail Returned to Sender"
+	}
+}
+
+func (k dsnKind) humanLine(rcpt *Recipient) string {
+	switch k {
+	case dsnDelay:
+		return "delivery delayed, will keep retrying"
+	case dsnSuccess:
+		return "delivered successfully"
+	default:
+		return "delivery failed: " + oneLine(rcpt.LastFailureMessage)
+	}
+}
+
+// deliveryStatusNotification builds a multipart/report DSN from dsnDomain,
+// for item, reporting on rcpts (a subset of item.Rcpt of the given kind).
+func deliveryStatusNotification(dsnDomain string, item *Item, kind dsnKind, rcpts []*Recipient) ([]byte, error) {
+	boundary := fmt.Sprintf("dsn_%s_%d", item.ID, time.Now().UnixNano())
+	from := "MAILER-DAEMON@" + dsnDomain
+
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", item.From)
+	fmt.Fprintf(&b, "Subject: %s\r\n", kind.subject())
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=%q\r\n", boundary)
+	fmt.Fprintf(&b, "\r\n")
+
+	// Human-readable part.
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "This is an automatically generated delivery status notification.\r\n\r\n")
+	for _, rcpt := range rcpts {
+		fmt.Fprintf(&b, "  %s: %s\r\n", rcpt.Address, kind.humanLine(rcpt))
+	}
+	fmt.Fprintf(&b, "\r\n")
+
+	// Machine-readable part (RFC 3464).
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", dsnDomain)
+	if item.EnvID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", item.EnvID)
+	}
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", item.CreatedAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "\r\n")
+
+	for _, rcpt := range rcpts {
+		if rcpt.OriginalRecipient != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s\r\n", rcpt.OriginalRecipient)
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", rcpt.Address)
+		fmt.Fprintf(&b, "Action: %s\r\n", kind.action())
+		fmt.Fprintf(&b, "Status: %s\r\n", kind.statusCode())
+		if rcpt.LastError != "" {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", oneLine(rcpt.LastError))
+		}
+		fmt.Fprintf(&b, "\r\n")
+	}
+
+	// Original message, possibly truncated to headers only (RET=HDRS).
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: message/rfc822\r\n\r\n")
+	b.Write(originalMessage(item))
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+
+	return b.Bytes(), nil
+}
+
+// originalMessage returns item.Data, truncated to headers only when the
+// message was submitted with RET=HDRS.
+func originalMessage(item *Item) []byte {
+	if item.Ret != RetHdrs {
+		return item.Data
+	}
+	if i := bytes.Index(item.Data, []byte("\r\n\r\n")); i >= 0 {
+		return item.Data[:i+2]
+	}
+	if i := bytes.Index(item.Data, []byte("\n\n")); i >= 0 {
+		return item.Data[:i+1]
+	}
+	return item.Data
+}
+
+func oneLine(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", " ")
+	s = strings.ReplaceAll(s, "\n", " ")
+	return strings.ReplaceAll(s, "\r", " ")
+}
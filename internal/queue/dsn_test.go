@@ -0,0 +1,145 @@
+package queue
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOriginalMessage(t *testing.T) {
+	cases := []struct {
+		name string
+		item *Item
+		want string
+	}{
+		{
+			name: "RetFull returns the whole message",
+			item: &Item{Ret: RetFull, Data: []byte("Subject: hi\r\n\r\nbody\r\n")},
+			want: "Subject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "RetHdrs truncates to headers only, crlf",
+			item: &Item{Ret: RetHdrs, Data: []byte("Subject: hi\r\n\r\nbody\r\n")},
+			want: "Subject: hi\r\n",
+		},
+		{
+			name: "RetHdrs truncates to headers only, bare lf",
+			item: &Item{Ret: RetHdrs, Data: []byte("Subject: hi\n\nbody\n")},
+			want: "Subject: hi\n",
+		},
+		{
+			name: "RetHdrs with no body separator returns everything",
+			item: &Item{Ret: RetHdrs, Data: []byte("Subject: hi")},
+			want: "Subject: hi",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := string(originalMessage(c.item))
+			if got != c.want {
+				t.Errorf("originalMessage() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRecipientsWarrantingFailureDSN(t *testing.T) {
+	cases := []struct {
+		name string
+		rcpt Recipient
+		want bool
+	}{
+		{
+			name: "failed, no NOTIFY given",
+			rcpt: Recipient{Status: Recipient_FAILED, Notify: Recipient_NotifyUnset},
+			want: true,
+		},
+		{
+			name: "pending (gave up on it), no NOTIFY given",
+			rcpt: Recipient{Status: Recipient_PENDING, Notify: Recipient_NotifyUnset},
+			want: true,
+		},
+		{
+			name: "sent successfully",
+			rcpt: Recipient{Status: Recipient_SENT, Notify: Recipient_NotifyUnset},
+			want: false,
+		},
+		{
+			name: "failed, NOTIFY=NEVER",
+			rcpt: Recipient{Status: Recipient_FAILED, Notify: Recipient_NotifyNever},
+			want: false,
+		},
+		{
+			name: "failed, NOTIFY=SUCCESS only",
+			rcpt: Recipient{Status: Recipient_FAILED, Notify: Recipient_NotifySuccess},
+			want: false,
+		},
+		{
+			name: "failed, NOTIFY=FAILURE",
+			rcpt: Recipient{Status: Recipient_FAILED, Notify: Recipient_NotifyFailure},
+			want: true,
+		},
+		{
+			name: "failed, NOTIFY=FAILURE|DELAY",
+			rcpt: Recipient{Status: Recipient_FAILED, Notify: Recipient_NotifyFailure | Recipient_NotifyDelay},
+			want: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			item := &Item{Rcpt: []*Recipient{&c.rcpt}}
+			got := len(recipientsWarrantingFailureDSN(item)) == 1
+			if got != c.want {
+				t.Errorf("recipientsWarrantingFailureDSN() included rcpt = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDeliveryStatusNotification(t *testing.T) {
+	item := &Item{
+		ID:        "abc123",
+		From:      "sender@example.com",
+		Data:      []byte("Subject: hi\r\n\r\nbody\r\n"),
+		CreatedAt: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		EnvID:     "envid-1",
+		Ret:       RetHdrs,
+	}
+	rcpt := &Recipient{
+		Address:           "rcpt@example.org",
+		OriginalRecipient: "rfc822;original@example.org",
+		LastError:         "connection refused",
+	}
+
+	msg, err := deliveryStatusNotification("dsn.example.com", item, dsnFailure, []*Recipient{rcpt})
+	if err != nil {
+		t.Fatalf("deliveryStatusNotification: %v", err)
+	}
+	s := string(msg)
+
+	wantContains := []string{
+		"From: MAILER-DAEMON@dsn.example.com\r\n",
+		"To: sender@example.com\r\n",
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"Reporting-MTA: dns; dsn.example.com\r\n",
+		"Original-Envelope-Id: envid-1\r\n",
+		"Original-Recipient: rfc822;original@example.org\r\n",
+		"Final-Recipient: rfc822; rcpt@example.org\r\n",
+		"Action: failed\r\n",
+		"Status: 5.0.0\r\n",
+		"Diagnostic-Code: smtp; connection refused\r\n",
+		"Content-Type: message/rfc822\r\n\r\nSubject: hi\r\n\r",
+	}
+	for _, want := range wantContains {
+		if !strings.Contains(s, want) {
+			t.Errorf("DSN missing %q in:\n%s", want, s)
+		}
+	}
+
+	// RET=HDRS: the body must not appear, only the truncated headers.
+	if strings.Contains(s, "body\r\n") {
+		t.Errorf("DSN with RET=HDRS included the message body:\n%s", s)
+	}
+}
@@ -0,0 +1,103 @@
+package queue
+
+// Prometheus metrics for the queue, alongside the existing expvar
+// counters. expvar is kept for backwards compatibility (and because
+// it's cheap to read from the admin console), but Prometheus lets
+// operators alert on queue growth and delivery latency in a way a flat
+// set of counters can't: by label (result, transport, domain) and with
+// histograms.
+
+import (
+	"net/http"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Note on cardinality: mDeliveryAttempts and mDeliveryDuration are
+// labeled by destination domain, which is unbounded for a busy relay -
+// every distinct domain anyone sends to creates a new time series, and
+// Prometheus never forgets one on its own. This is a known scaling
+// hazard; if it becomes a problem in practice, consider bucketing
+// long-tail domains (e.g. below some volume threshold) under a single
+// "other" label instead of tracking each one indefinitely.
+var (
+	mQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chasquid_queue_length",
+		Help: "Number of items currently in the queue.",
+	})
+	mQueueOldestItemAge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chasquid_queue_oldest_item_age_seconds",
+		Help: "Age of the oldest item currently in the queue, in seconds.",
+	})
+	mDeliveryAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chasquid_queue_delivery_attempts_total",
+		Help: "Delivery attempts, by result, transport and domain.",
+	}, []string{"result", "transport", "domain"})
+	mDeliveryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "chasquid_queue_delivery_duration_seconds",
+		Help: "Time taken by delivery attempts, by transport and domain.",
+		// Prometheus's default buckets top out at 10s, but remote SMTP
+		// deliveries routinely take longer than that to dial, negotiate
+		// TLS, and complete a transaction - with the defaults, nearly
+		// every observation would land in +Inf and the histogram would
+		// be useless for alerting on latency. These span from
+		// sub-second local/pipe deliveries to several minutes.
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{"transport", "domain"})
+	mDSNSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chasquid_queue_dsn_sent_total",
+		Help: "DSNs sent, by kind (delay, failure, success).",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		mQueueLength, mQueueOldestItemAge, mDeliveryAttempts,
+		mDeliveryDuration, mDSNSent)
+}
+
+// CollectMetrics refreshes the queue-wide gauges (length, oldest item
+// age) from the store. The scheduler calls this on every tick, so it
+// uses Count() and an indexed CreatedAt lookup rather than materializing
+// every item (with its recipients) on each call - important for queues
+// meant to hold tens of thousands of messages (see chunk0-1).
+func (q *Queue) CollectMetrics() {
+	n, err := q.store.Len()
+	if err != nil {
+		log.Errorf("metrics: error counting queue: %v", err)
+		return
+	}
+	mQueueLength.Set(float64(n))
+
+	oldest, ok, err := q.store.OldestCreatedAt()
+	if err != nil {
+		log.Errorf("metrics: error finding oldest item: %v", err)
+		return
+	}
+	var age time.Duration
+	if ok {
+		age = time.Since(oldest)
+	}
+	mQueueOldestItemAge.Set(age.Seconds())
+}
+
+// MetricsHandler returns the HTTP handler to serve Prometheus metrics
+// from, for mounting on the admin HTTP surface (typically at /metrics).
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+func dsnKindLabel(kind dsnKind) string {
+	switch kind {
+	case dsnDelay:
+		return "delay"
+	case dsnSuccess:
+		return "success"
+	default:
+		return "failure"
+	}
+}
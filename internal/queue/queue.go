@@ -2,9 +2,6 @@
 // Accepted envelopes get put in the queue, and processed asynchronously.
 package queue
 
-// Command to generate queue.pb.go from queue.proto.
-//go:generate protoc --go_out=. -I=${GOPATH}/src -I. queue.proto
-
 import (
 	"context"
 	"encoding/base64"
@@ -13,9 +10,7 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
 	"bytes"
@@ -24,30 +19,16 @@ import (
 	"blitiri.com.ar/go/chasquid/internal/courier"
 	"blitiri.com.ar/go/chasquid/internal/envelope"
 	"blitiri.com.ar/go/chasquid/internal/log"
-	"blitiri.com.ar/go/chasquid/internal/maillog"
-	"blitiri.com.ar/go/chasquid/internal/protoio"
 	"blitiri.com.ar/go/chasquid/internal/set"
 	"blitiri.com.ar/go/chasquid/internal/trace"
 
-	"github.com/golang/protobuf/ptypes"
-	"github.com/golang/protobuf/ptypes/timestamp"
 	"golang.org/x/net/idna"
 )
 
-const (
-	// Maximum size of the queue; we reject emails when we hit this.
-	maxQueueSize = 200
-
-	// Give up sending attempts after this duration.
-	giveUpAfter = 12 * time.Hour
-
-	// Prefix for item file names.
-	// This is for convenience, versioning, and to be able to tell them apart
-	// temporary files and other cruft.
-	// It's important that it's outside the base64 space so it doesn't get
-	// generated accidentally.
-	itemFilePrefix = "m:"
-)
+// defaultMaxQueueSize is the default maximum size of the queue; we
+// reject new mail when we hit this, unless overridden via
+// Queue.SetMaxQueueSize.
+const defaultMaxQueueSize = 200
 
 var (
 	errQueueFull = fmt.Errorf("Queue size too big, try again later")
@@ -87,11 +68,9 @@ func init() {
 
 // Queue that keeps mail waiting for delivery.
 type Queue struct {
-	// Items in the queue. Map of id -> Item.
-	q map[string]*Item
-
-	// Mutex protecting q.
-	mu sync.RWMutex
+	// Durable store backing the queue. Items and recipients are indexed
+	// records here, instead of living in an in-memory map.
+	store *Store
 
 	// Couriers to use to deliver mail.
 	localC  courier.Courier
@@ -108,6 +87,33 @@ type Queue struct {
 
 	// Domain we use to send delivery status notifications from.
 	dsnDomain string
+
+	// Per-destination-domain concurrency and rate limits, enforced by the
+	// scheduler when dispatching remote deliveries.
+	throttle *throttle
+
+	// Recently-sent message tuples, to avoid double delivery on retry
+	// after a flaky client resubmission or a crash mid-delivery.
+	sendRecorder *SendRecorder
+
+	// Per-destination-domain retry policies (backoff, give-up deadline,
+	// delayed-DSN threshold), enforced by the scheduler.
+	retry *retryPolicies
+
+	// workSem bounds how many deliveries the scheduler has in flight at
+	// once, across ticks; see Queue.dispatch.
+	workSem chan struct{}
+
+	// Recipients with a worker currently dispatching a delivery attempt
+	// for them, so a slow delivery that's still running on a later tick
+	// doesn't get a second, overlapping worker; see dispatchTracker.
+	inFlight *dispatchTracker
+
+	// Maximum number of items the queue will hold; see SetMaxQueueSize.
+	maxQueueSize int
+
+	// Signals the scheduler to stop; closed by Close.
+	stop chan struct{}
 }
 
 // New creates a new Queue instance.
@@ -116,61 +122,128 @@ func New(path string, localDomains *set.String, aliases *aliases.Resolver,
 
 	os.MkdirAll(path, 0700)
 
+	store, err := newStore(path)
+	if err != nil {
+		// The queue is not usable without its store; callers are expected
+		// to check for this during startup, much like they would for a
+		// failure to create the queue directory.
+		log.Fatalf("failed to open queue store: %v", err)
+	}
+
+	sendRecorder, err := newSendRecorder(store, sendRecordWindow)
+	if err != nil {
+		log.Fatalf("failed to load send recorder state: %v", err)
+	}
+
 	return &Queue{
-		q:            map[string]*Item{},
+		store:        store,
 		localC:       localC,
 		remoteC:      remoteC,
 		localDomains: localDomains,
 		path:         path,
 		aliases:      aliases,
 		dsnDomain:    dsnDomain,
+		throttle:     newThrottle(),
+		sendRecorder: sendRecorder,
+		retry:        newRetryPolicies(),
+		workSem:      make(chan struct{}, maxWorkers),
+		inFlight:     newDispatchTracker(),
+		maxQueueSize: defaultMaxQueueSize,
+		stop:         make(chan struct{}),
 	}
 }
 
-// Load the queue and launch the sending loops on startup.
+// SetMaxQueueSize overrides the maximum number of items the queue will
+// hold; Put returns an error once it's reached. The default is
+// defaultMaxQueueSize.
+func (q *Queue) SetMaxQueueSize(n int) {
+	q.maxQueueSize = n
+}
+
+// Load the queue and launch the scheduler.
 func (q *Queue) Load() error {
-	files, err := filepath.Glob(q.path + "/" + itemFilePrefix + "*")
+	items, err := q.store.LoadAll()
 	if err != nil {
 		return err
 	}
 
-	for _, fname := range files {
-		item, err := ItemFromFile(fname)
-		if err != nil {
-			log.Errorf("error loading queue item from %q: %v", fname, err)
-			continue
+	for _, item := range items {
+		if item.countRcpt(Recipient_PENDING) == 0 {
+			// Nothing left to do for this item; it was likely interrupted
+			// right before it would have been removed.
+			q.store.RemoveItem(item.ID)
 		}
-
-		q.mu.Lock()
-		q.q[item.ID] = item
-		q.mu.Unlock()
-
-		go item.SendLoop(q)
 	}
 
+	go q.scheduler()
+	go q.sendRecorder.sweep(q.stop)
+
 	return nil
 }
 
+// Close stops the scheduler and closes the underlying store. Pending
+// items are left in the store, to be picked up again on the next Load.
+func (q *Queue) Close() error {
+	close(q.stop)
+	return q.store.Close()
+}
+
 func (q *Queue) Len() int {
-	q.mu.RLock()
-	defer q.mu.RUnlock()
-	return len(q.q)
+	n, err := q.store.Len()
+	if err != nil {
+		log.Errorf("error getting queue length: %v", err)
+	}
+	return n
+}
+
+// DSNArgs carries the RFC 3461 parameters for a single Put call: a
+// per-message ENVID/RET, and per-recipient NOTIFY/ORCPT, keyed by the
+// recipient address as given in `to`.
+//
+// The queue honors these once it has them (see sendDSN, sendSuccessDSN,
+// maybeSendDelayDSN, and DSNCourier), but nothing in this tree parses
+// MAIL FROM/RCPT TO parameters yet and populates DSNArgs from them - the
+// SMTP frontend that would do so lives outside this package, and every
+// in-tree Put call passes DSNArgs{}. Until that frontend work lands,
+// NOTIFY/ORCPT/RET/ENVID are only exercised by callers that build
+// DSNArgs themselves.
+type DSNArgs struct {
+	EnvID string
+	Ret   RetType
+
+	Notify map[string]Recipient_Notify
+	ORcpt  map[string]string
 }
 
 // Put an envelope in the queue.
-func (q *Queue) Put(from string, to []string, data []byte) (string, error) {
-	if q.Len() >= maxQueueSize {
+func (q *Queue) Put(from string, to []string, data []byte, dsn DSNArgs) (string, error) {
+	if q.Len() >= q.maxQueueSize {
 		return "", errQueueFull
 	}
+
+	// Prefixed so it can't match the per-recipient delivery keys that
+	// sendOneRcpt and dispatchBatch record and check.
+	key := "queued\x00" + sendKey(from, to, data)
+	if existingID, ok := q.sendRecorder.Lookup(key); ok {
+		// The same message was already queued for these recipients very
+		// recently; most likely a flaky client retrying a submission it
+		// thinks failed. Report it as queued (returning the ID of the
+		// original, already-in-flight item) rather than as an error: an
+		// error here would make the caller (e.g. the SMTP frontend) tell
+		// the client to retry, which is the opposite of what we want.
+		return existingID, nil
+	}
+
 	putCount.Add(1)
 
+	now := time.Now()
 	item := &Item{
-		Message: Message{
-			ID:   <-newID,
-			From: from,
-			Data: data,
-		},
-		CreatedAt: time.Now(),
+		ID:        <-newID,
+		From:      from,
+		Data:      data,
+		CreatedAt: now,
+		EnvID:     dsn.EnvID,
+		Ret:       dsn.Ret,
 	}
 
 	for _, t := range to {
@@ -185,9 +258,12 @@ func (q *Queue) Put(from string, to []string, data []byte) (string, error) {
 		// not very pretty but at least it's self contained.
 		for _, aliasRcpt := range rcpts {
 			r := &Recipient{
-				Address:         aliasRcpt.Addr,
-				Status:          Recipient_PENDING,
-				OriginalAddress: t,
+				Address:           aliasRcpt.Addr,
+				Status:            Recipient_PENDING,
+				OriginalAddress:   t,
+				NextAttempt:       now,
+				Notify:            dsn.Notify[t],
+				OriginalRecipient: dsn.ORcpt[t],
 			}
 			switch aliasRcpt.Type {
 			case aliases.EMAIL:
@@ -203,179 +279,226 @@ func (q *Queue) Put(from string, to []string, data []byte) (string, error) {
 		}
 	}
 
-	err := item.WriteTo(q.path)
-	if err != nil {
+	if err := q.store.InsertItem(item); err != nil {
 		return "", fmt.Errorf("failed to write item: %v", err)
 	}
-
-	q.mu.Lock()
-	q.q[item.ID] = item
-	q.mu.Unlock()
-
-	// Begin to send it right away.
-	go item.SendLoop(q)
+	itemsWritten.Add(1)
+	q.sendRecorder.Record(key, item.ID)
 
 	return item.ID, nil
 }
 
 // Remove an item from the queue.
 func (q *Queue) Remove(id string) {
-	path := fmt.Sprintf("%s/%s%s", q.path, itemFilePrefix, id)
-	err := os.Remove(path)
-	if err != nil {
-		log.Errorf("failed to remove queue file %q: %v", path, err)
+	if err := q.store.RemoveItem(id); err != nil {
+		log.Errorf("failed to remove queue item %q: %v", id, err)
 	}
-
-	q.mu.Lock()
-	delete(q.q, id)
-	q.mu.Unlock()
 }
 
 // DumpString returns a human-readable string with the current queue.
 // Useful for debugging purposes.
 func (q *Queue) DumpString() string {
-	q.mu.RLock()
-	defer q.mu.RUnlock()
+	items, err := q.store.LoadAll()
+	if err != nil {
+		return fmt.Sprintf("# Queue status\n\nerror: %v\n", err)
+	}
+
 	s := fmt.Sprintf("# Queue status\n\n")
 	s += fmt.Sprintf("date: %v\n", time.Now())
-	s += fmt.Sprintf("length: %d\n\n", len(q.q))
+	s += fmt.Sprintf("length: %d\n\n", len(items))
 
-	for id, item := range q.q {
-		s += fmt.Sprintf("## Item %s\n", id)
-		item.Lock()
+	for _, item := range items {
+		s += fmt.Sprintf("## Item %s\n", item.ID)
 		s += fmt.Sprintf("created at: %s\n", item.CreatedAt)
 		s += fmt.Sprintf("from: %s\n", item.From)
 		s += fmt.Sprintf("to: %s\n", item.To)
 		for _, rcpt := range item.Rcpt {
 			s += fmt.Sprintf("%s %s (%s)\n", rcpt.Status, rcpt.Address, rcpt.Type)
 			s += fmt.Sprintf("  original address: %s\n", rcpt.OriginalAddress)
+			s += fmt.Sprintf("  attempts: %d  next: %s\n", rcpt.Attempts, rcpt.NextAttempt)
 			s += fmt.Sprintf("  last failure: %q\n", rcpt.LastFailureMessage)
 		}
-		item.Unlock()
 		s += fmt.Sprintf("\n")
 	}
 
 	return s
 }
 
-// An item in the queue.
-type Item struct {
-	// Base the item on the protobuf message.
-	// We will use this for serialization, so any fields below are NOT
-	// serialized.
-	Message
+// Recipient_Type identifies the kind of delivery a Recipient expects.
+type Recipient_Type int
 
-	// Protect the entire item.
-	sync.Mutex
+const (
+	Recipient_EMAIL Recipient_Type = iota
+	Recipient_PIPE
+)
 
-	// Go-friendly version of Message.CreatedAtTs.
-	CreatedAt time.Time
+func (t Recipient_Type) String() string {
+	switch t {
+	case Recipient_EMAIL:
+		return "EMAIL"
+	case Recipient_PIPE:
+		return "PIPE"
+	default:
+		return "UNKNOWN"
+	}
 }
 
-func ItemFromFile(fname string) (*Item, error) {
-	item := &Item{}
-	err := protoio.ReadTextMessage(fname, &item.Message)
-	if err != nil {
-		return nil, err
-	}
+// Recipient_Status is the delivery status of a Recipient.
+type Recipient_Status int
+
+const (
+	Recipient_PENDING Recipient_Status = iota
+	Recipient_SENT
+	Recipient_FAILED
+)
 
-	item.CreatedAt, err = ptypes.Timestamp(item.CreatedAtTs)
-	return item, err
+func (s Recipient_Status) String() string {
+	switch s {
+	case Recipient_PENDING:
+		return "PENDING"
+	case Recipient_SENT:
+		return "SENT"
+	case Recipient_FAILED:
+		return "FAILED"
+	default:
+		return "UNKNOWN"
+	}
 }
 
-func (item *Item) WriteTo(dir string) error {
-	item.Lock()
-	defer item.Unlock()
-	itemsWritten.Add(1)
+// Recipient of an Item, and the state of its delivery. Kept as its own
+// record in the store (see store.go), indexed by NextAttempt so the
+// scheduler can find due work without scanning the whole queue.
+type Recipient struct {
+	ID     int64  `bstore:"primary"`
+	ItemID string `bstore:"index"`
+
+	Address            string
+	Type               Recipient_Type
+	Status             Recipient_Status
+	OriginalAddress    string
+	LastFailureMessage string
+
+	// NextAttempt is when this recipient is next due for a delivery
+	// attempt.
+	NextAttempt time.Time `bstore:"index"`
+	Attempts    int
+	LastAttempt time.Time
+
+	// IPs we've already dialed while attempting delivery, most recent
+	// last; used by the courier to avoid retrying the same host.
+	DialedIPs []string
+	LastError string
+
+	// RFC 3461 DSN parameters for this recipient, as given by the client
+	// on RCPT TO.
+	Notify            Recipient_Notify
+	OriginalRecipient string // ORCPT, e.g. "rfc822;jdoe@example.org".
+
+	// Whether we've already sent a NOTIFY=DELAY DSN for this recipient,
+	// so we don't send more than one while it keeps getting retried.
+	DelayDSNSent bool
+}
 
-	var err error
-	item.CreatedAtTs, err = ptypes.TimestampProto(item.CreatedAt)
-	if err != nil {
-		return err
-	}
+// Recipient_Notify is a bitmask of the RFC 3461 NOTIFY conditions a
+// client asked to be told about, for a single recipient.
+type Recipient_Notify int
 
-	path := fmt.Sprintf("%s/%s%s", dir, itemFilePrefix, item.ID)
+// Recipient_NotifyUnset (the zero value) means the client didn't send a
+// NOTIFY parameter; we fall back to our historic behaviour of notifying
+// on failure only.
+const (
+	Recipient_NotifyUnset   Recipient_Notify = 0
+	Recipient_NotifyNever   Recipient_Notify = 1 << 0
+	Recipient_NotifySuccess Recipient_Notify = 1 << 1
+	Recipient_NotifyFailure Recipient_Notify = 1 << 2
+	Recipient_NotifyDelay   Recipient_Notify = 1 << 3
+)
 
-	return protoio.WriteTextMessage(path, &item.Message, 0600)
+func (n Recipient_Notify) has(flag Recipient_Notify) bool {
+	return n&flag != 0
 }
 
-func (item *Item) SendLoop(q *Queue) {
-	tr := trace.New("Queue.SendLoop", item.ID)
-	defer tr.Finish()
-	tr.Printf("from %s", item.From)
+// RetType is the RFC 3461 RET parameter for a message: whether a bounce
+// should return the full message, or just its headers.
+type RetType int
 
-	for time.Since(item.CreatedAt) < giveUpAfter {
-		// Send to all recipients that are still pending.
-		var wg sync.WaitGroup
-		for _, rcpt := range item.Rcpt {
-			if rcpt.Status != Recipient_PENDING {
-				continue
-			}
+const (
+	RetFull RetType = iota
+	RetHdrs
+)
 
-			wg.Add(1)
-			go item.sendOneRcpt(&wg, tr, q, rcpt)
-		}
-		wg.Wait()
+// An item in the queue: a single message, with one or more recipients.
+type Item struct {
+	ID        string `bstore:"primary"`
+	From      string
+	Data      []byte
+	To        []string
+	CreatedAt time.Time `bstore:"index"`
+
+	// RFC 3461 DSN parameters for the message as a whole, as given by
+	// the client on MAIL FROM.
+	EnvID string
+	Ret   RetType
+
+	// Recipients for this item. Loaded from, and persisted to, their own
+	// store records; not stored as part of the item itself.
+	Rcpt []*Recipient `bstore:"-"`
+}
 
-		// If they're all done, no need to wait.
-		if item.countRcpt(Recipient_PENDING) == 0 {
-			break
+// countRcpt counts how many recipients are in the given status.
+func (item *Item) countRcpt(statuses ...Recipient_Status) int {
+	c := 0
+	for _, rcpt := range item.Rcpt {
+		for _, status := range statuses {
+			if rcpt.Status == status {
+				c++
+				break
+			}
 		}
-
-		// TODO: Consider sending a non-final notification after 30m or so,
-		// that some of the messages have been delayed.
-
-		delay := nextDelay(item.CreatedAt)
-		tr.Printf("waiting for %v", delay)
-		maillog.QueueLoop(item.ID, item.From, delay)
-		time.Sleep(delay)
 	}
+	return c
+}
 
-	// Completed to all recipients (some may not have succeeded).
-	if item.countRcpt(Recipient_FAILED, Recipient_PENDING) > 0 && item.From != "<>" {
-		sendDSN(tr, q, item)
+// transportFor returns the ("pipe"/"local"/"remote", domain) labels used
+// for per-recipient delivery metrics. Used by deliver; the batch delivery
+// path (see batch.go) only handles remote recipients and labels them
+// "remote" directly.
+func transportFor(q *Queue, rcpt *Recipient) (transport, domain string) {
+	if rcpt.Type != Recipient_EMAIL {
+		return "pipe", ""
 	}
-
-	tr.Printf("all done")
-	maillog.QueueLoop(item.ID, item.From, 0)
-	q.Remove(item.ID)
+	domain = envelope.DomainOf(rcpt.Address)
+	if envelope.DomainIn(rcpt.Address, q.localDomains) {
+		return "local", domain
+	}
+	return "remote", domain
 }
 
-// sendOneRcpt, and update it with the results.
-func (item *Item) sendOneRcpt(wg *sync.WaitGroup, tr *trace.Trace, q *Queue, rcpt *Recipient) {
-	defer wg.Done()
-	to := rcpt.Address
-	tr.Debugf("%s sending", to)
-
-	err, permanent := item.deliver(q, rcpt)
-
-	item.Lock()
+// recordDeliveryMetrics updates the Prometheus instrumentation for a
+// single delivery attempt that began at start. The expvar
+// deliverAttempts counter is updated by the callers.
+func recordDeliveryMetrics(transport, domain string, start time.Time, err error, permanent bool) {
+	mDeliveryDuration.WithLabelValues(transport, domain).Observe(time.Since(start).Seconds())
+	result := "success"
 	if err != nil {
-		rcpt.LastFailureMessage = err.Error()
+		result = "temp_fail"
 		if permanent {
-			tr.Errorf("%s permanent error: %v", to, err)
-			maillog.SendAttempt(item.ID, item.From, to, err, true)
-			rcpt.Status = Recipient_FAILED
-		} else {
-			tr.Printf("%s temporary error: %v", to, err)
-			maillog.SendAttempt(item.ID, item.From, to, err, false)
+			result = "perm_fail"
 		}
-	} else {
-		tr.Printf("%s sent", to)
-		maillog.SendAttempt(item.ID, item.From, to, nil, false)
-		rcpt.Status = Recipient_SENT
-	}
-	item.Unlock()
-
-	err = item.WriteTo(q.path)
-	if err != nil {
-		tr.Errorf("failed to write: %v", err)
 	}
+	mDeliveryAttempts.WithLabelValues(result, transport, domain).Inc()
 }
 
 // deliver the item to the given recipient, using the couriers from the queue.
 // Return an error (if any), and whether it is permanent or not.
 func (item *Item) deliver(q *Queue, rcpt *Recipient) (err error, permanent bool) {
+	transport, domain := transportFor(q, rcpt)
+
+	start := time.Now()
+	defer func() {
+		recordDeliveryMetrics(transport, domain, start, err, permanent)
+	}()
+
 	if rcpt.Type == Recipient_PIPE {
 		deliverAttempts.Add("pipe", 1)
 		c := strings.Fields(rcpt.Address)
@@ -413,34 +536,68 @@ func (item *Item) deliver(q *Queue, rcpt *Recipient) (err error, permanent bool)
 				strings.Replace(from, "@", "=", -1),
 				mustIDNAToASCII(envelope.DomainOf(rcpt.OriginalAddress)))
 		}
+
+		// If the courier knows how to forward RFC 3461 parameters on
+		// RCPT TO (which it will only do if the peer advertised DSN
+		// support), give it the chance to do so.
+		if dc, ok := q.remoteC.(DSNCourier); ok {
+			return dc.DeliverDSN(from, rcpt.Address, item.Data, rcpt.Notify, rcpt.OriginalRecipient)
+		}
 		return q.remoteC.Deliver(from, rcpt.Address, item.Data)
 	}
 }
 
-// countRcpt counts how many recipients are in the given status.
-func (item *Item) countRcpt(statuses ...Recipient_Status) int {
-	c := 0
+// DSNCourier is implemented by couriers that can forward RFC 3461
+// parameters (NOTIFY, ORCPT) on RCPT TO, for peers that advertise DSN
+// support. Couriers that don't implement it are delivered to via the
+// plain Courier.Deliver, same as before.
+//
+// Like BatchCourier, this is an opt-in extension point: no courier in
+// this tree implements it yet, so forwarding NOTIFY/ORCPT on RCPT TO to
+// a peer doesn't engage until the SMTP courier (outside this package)
+// grows a DeliverDSN method.
+type DSNCourier interface {
+	DeliverDSN(from, to string, data []byte, notify Recipient_Notify, orcpt string) (err error, permanent bool)
+}
+
+// recipientsWarrantingFailureDSN returns the subset of item.Rcpt that
+// didn't make it, and that asked (or didn't say otherwise) to be told
+// about failures, for sendDSN to report on.
+func recipientsWarrantingFailureDSN(item *Item) []*Recipient {
+	var out []*Recipient
 	for _, rcpt := range item.Rcpt {
-		for _, status := range statuses {
-			if rcpt.Status == status {
-				c++
-				break
-			}
+		if rcpt.Status != Recipient_FAILED && rcpt.Status != Recipient_PENDING {
+			continue
+		}
+		if rcpt.Notify == Recipient_NotifyNever {
+			continue
+		}
+		if rcpt.Notify != Recipient_NotifyUnset && !rcpt.Notify.has(Recipient_NotifyFailure) {
+			continue
 		}
+		out = append(out, rcpt)
 	}
-	return c
+	return out
 }
 
+// sendDSN sends a failure DSN covering every recipient of item that
+// didn't make it, and that asked (or didn't say otherwise) to be told
+// about failures.
 func sendDSN(tr *trace.Trace, q *Queue, item *Item) {
-	tr.Debugf("sending DSN")
+	failed := recipientsWarrantingFailureDSN(item)
+	if len(failed) == 0 {
+		tr.Debugf("no recipients warrant a failure DSN")
+		return
+	}
 
-	msg, err := deliveryStatusNotification(q.dsnDomain, item)
+	tr.Debugf("sending DSN")
+	msg, err := deliveryStatusNotification(q.dsnDomain, item, dsnFailure, failed)
 	if err != nil {
 		tr.Errorf("failed to build DSN: %v", err)
 		return
 	}
 
-	id, err := q.Put("<>", []string{item.From}, msg)
+	id, err := q.Put("<>", []string{item.From}, msg, DSNArgs{})
 	if err != nil {
 		tr.Errorf("failed to queue DSN: %v", err)
 		return
@@ -448,33 +605,60 @@ func sendDSN(tr *trace.Trace, q *Queue, item *Item) {
 
 	tr.Printf("queued DSN: %s", id)
 	dsnQueued.Add(1)
+	mDSNSent.WithLabelValues(dsnKindLabel(dsnFailure)).Inc()
 }
 
-func nextDelay(createdAt time.Time) time.Duration {
-	var delay time.Duration
-
-	since := time.Since(createdAt)
-	switch {
-	case since < 1*time.Minute:
-		delay = 1 * time.Minute
-	case since < 5*time.Minute:
-		delay = 5 * time.Minute
-	case since < 10*time.Minute:
-		delay = 10 * time.Minute
-	default:
-		delay = 20 * time.Minute
+// sendSuccessDSN sends a DSN for a single recipient that was just
+// delivered successfully, as requested via NOTIFY=SUCCESS.
+func sendSuccessDSN(tr *trace.Trace, q *Queue, item *Item, rcpt *Recipient) {
+	msg, err := deliveryStatusNotification(q.dsnDomain, item, dsnSuccess, []*Recipient{rcpt})
+	if err != nil {
+		tr.Errorf("failed to build success DSN: %v", err)
+		return
 	}
 
-	// Perturb the delay, to avoid all queued emails to be retried at the
-	// exact same time after a restart.
-	delay += time.Duration(rand.Intn(60)) * time.Second
-	return delay
+	id, err := q.Put("<>", []string{item.From}, msg, DSNArgs{})
+	if err != nil {
+		tr.Errorf("failed to queue success DSN: %v", err)
+		return
+	}
+
+	tr.Printf("queued success DSN: %s", id)
+	dsnQueued.Add(1)
+	mDSNSent.WithLabelValues(dsnKindLabel(dsnSuccess)).Inc()
 }
 
-func timestampNow() *timestamp.Timestamp {
-	now := time.Now()
-	ts, _ := ptypes.TimestampProto(now)
-	return ts
+// maybeSendDelayDSN sends a one-off NOTIFY=DELAY DSN for rcpt once it's
+// been pending for longer than its domain's DelayDSNAfter threshold, and
+// hasn't had one sent already.
+func maybeSendDelayDSN(tr *trace.Trace, q *Queue, item *Item, rcpt *Recipient) {
+	if rcpt.Status != Recipient_PENDING || rcpt.DelayDSNSent {
+		return
+	}
+	if !rcpt.Notify.has(Recipient_NotifyDelay) {
+		return
+	}
+	policy := q.retry.get(domainOf(rcpt))
+	if time.Since(item.CreatedAt) < policy.DelayDSNAfter {
+		return
+	}
+
+	msg, err := deliveryStatusNotification(q.dsnDomain, item, dsnDelay, []*Recipient{rcpt})
+	if err != nil {
+		tr.Errorf("failed to build delay DSN: %v", err)
+		return
+	}
+	if _, err := q.Put("<>", []string{item.From}, msg, DSNArgs{}); err != nil {
+		tr.Errorf("failed to queue delay DSN: %v", err)
+		return
+	}
+
+	rcpt.DelayDSNSent = true
+	if err := q.store.UpdateRecipient(rcpt); err != nil {
+		tr.Errorf("failed to write: %v", err)
+	}
+	dsnQueued.Add(1)
+	mDSNSent.WithLabelValues(dsnKindLabel(dsnDelay)).Inc()
 }
 
 func mustIDNAToASCII(s string) string {
@@ -0,0 +1,101 @@
+package queue
+
+// The queue's retry policy: how long to wait between delivery attempts,
+// how long to keep trying before giving up on a recipient, and when to
+// warn the sender that delivery is taking a while. It is deliberately
+// split out from the fixed schedule the queue used to have (a 1m/5m/
+// 10m/20m ladder capped at 60s of jitter, giving up after 12h), which is
+// far more aggressive than most MTAs and caused both unnecessary
+// retries during short blips and premature bounces during longer ones.
+//
+// Like the per-domain concurrency and rate limits in throttle.go, the
+// policy can be overridden per destination domain.
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy controls delivery retries to a destination domain.
+type RetryPolicy struct {
+	// BaseDelay is the delay before the first retry; it doubles on each
+	// subsequent attempt, up to MaxDelay.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the exponential backoff.
+	MaxDelay time.Duration
+
+	// MaxLifetime is how long we keep retrying a recipient before giving
+	// up on it entirely.
+	MaxLifetime time.Duration
+
+	// DelayDSNAfter is how long a recipient must have been pending
+	// before we warn the sender with a NOTIFY=DELAY DSN.
+	DelayDSNAfter time.Duration
+}
+
+// defaultRetryPolicy is used for domains without an override. It
+// follows RFC 5321 §4.5.4.1's suggested minimums: a warning around 4
+// hours in, and giving up after 4-5 days.
+var defaultRetryPolicy = RetryPolicy{
+	BaseDelay:     1 * time.Minute,
+	MaxDelay:      4 * time.Hour,
+	MaxLifetime:   5 * 24 * time.Hour,
+	DelayDSNAfter: 4 * time.Hour,
+}
+
+// nextDelay returns how long to wait before the next delivery attempt,
+// given how many attempts have already been made. It uses exponential
+// backoff with full jitter (as recommended in
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/):
+// a uniformly random duration between 0 and the capped exponential
+// value, so that many messages queued during an outage don't all retry
+// in lockstep once it clears.
+func (p RetryPolicy) nextDelay(attempts int) time.Duration {
+	delay := p.MaxDelay
+	// The first retry (after one attempt) uses BaseDelay unshifted.
+	shift := attempts - 1
+	if shift < 0 {
+		shift = 0
+	}
+	if shift < 32 { // avoid overflowing the shift for pathological cases
+		if d := p.BaseDelay << uint(shift); d > 0 && d < p.MaxDelay {
+			delay = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// retryPolicies is a per-destination-domain registry of RetryPolicy,
+// falling back to defaultRetryPolicy for domains without an override.
+type retryPolicies struct {
+	mu       sync.Mutex
+	policies map[string]RetryPolicy
+}
+
+func newRetryPolicies() *retryPolicies {
+	return &retryPolicies{policies: map[string]RetryPolicy{}}
+}
+
+func (r *retryPolicies) set(domain string, policy RetryPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policies[domain] = policy
+}
+
+func (r *retryPolicies) get(domain string) RetryPolicy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.policies[domain]; ok {
+		return p
+	}
+	return defaultRetryPolicy
+}
+
+// SetRetryPolicy overrides the retry policy (backoff, maximum lifetime,
+// and delayed-DSN threshold) for a single destination domain. Domains
+// without an override use defaultRetryPolicy.
+func (q *Queue) SetRetryPolicy(domain string, policy RetryPolicy) {
+	q.retry.set(domain, policy)
+}
@@ -0,0 +1,381 @@
+package queue
+
+// The scheduler is the single goroutine that drives delivery for the
+// whole queue. Instead of every Item running its own SendLoop and
+// time.Sleep (the old design), it periodically asks the store for
+// recipients that are due for a delivery attempt, and dispatches a
+// worker for each. This scales much better than one goroutine per item,
+// and makes admin operations (list/inspect/kick/hold/drop) simple DB
+// queries instead of walks over a map protected by a global mutex.
+
+import (
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/envelope"
+	"blitiri.com.ar/go/chasquid/internal/log"
+	"blitiri.com.ar/go/chasquid/internal/maillog"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// schedulerTick is how often the scheduler polls the store for due
+// recipients.
+const schedulerTick = 1 * time.Second
+
+// maxWorkers bounds how many deliveries the scheduler will have in
+// flight at once, across ticks (see workSem in dispatch).
+const maxWorkers = 50
+
+// dueFetchLimit bounds how many due recipients we pull per tick, well
+// beyond maxWorkers. dispatchDue round-robins across destination
+// domains when deciding what to dispatch, so it needs more candidates
+// than it will actually launch: with a tight limit, a single saturated
+// or throttled domain filling the whole page would starve every other
+// domain's due mail (see chunk0-2).
+const dueFetchLimit = maxWorkers * 4
+
+// dispatchTracker tracks which recipients currently have a worker
+// dispatching a delivery attempt for them, so dispatchDue doesn't hand
+// the same recipient to a second worker while the first one (possibly
+// from an earlier tick, since dispatch no longer waits for a tick's
+// workers to finish before the next one runs) is still in flight.
+type dispatchTracker struct {
+	mu     sync.Mutex
+	active map[int64]bool
+}
+
+func newDispatchTracker() *dispatchTracker {
+	return &dispatchTracker{active: map[int64]bool{}}
+}
+
+// tryStart reports whether rcptID wasn't already in flight, and if so,
+// marks it as such; the caller must call finish(rcptID) once its
+// delivery attempt completes.
+func (t *dispatchTracker) tryStart(rcptID int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active[rcptID] {
+		return false
+	}
+	t.active[rcptID] = true
+	return true
+}
+
+func (t *dispatchTracker) finish(rcptID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.active, rcptID)
+}
+
+// scheduler is the main loop; run once, from Load.
+func (q *Queue) scheduler() {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			q.dispatchDue()
+			q.CollectMetrics()
+		}
+	}
+}
+
+// dispatch runs job in its own goroutine, gated by workSem so at most
+// maxWorkers run at once across the whole queue's lifetime, not just
+// within one tick. Unlike the previous per-tick sync.WaitGroup, dispatch
+// never blocks the caller on job's completion: the scheduler goroutine
+// that calls dispatchDue returns immediately, so one slow or hung
+// delivery can't stall dispatch of everything else that's due.
+func (q *Queue) dispatch(job func()) {
+	go func() {
+		q.workSem <- struct{}{}
+		defer func() { <-q.workSem }()
+		job()
+	}()
+}
+
+// dispatchDue finds recipients that are due for an attempt, and hands
+// each to a worker, up to maxWorkers in flight at a time (see dispatch).
+// Recipients of the same item heading to the same remote domain are
+// grouped together, so they can be delivered as a single batch (see
+// batch.go) when the configured remote courier supports it.
+func (q *Queue) dispatchDue() {
+	rcpts, err := q.store.DueRecipients(time.Now(), dueFetchLimit)
+	if err != nil {
+		log.Errorf("scheduler: error querying due recipients: %v", err)
+		return
+	}
+
+	batchC, canBatch := q.remoteC.(BatchCourier)
+
+	// Bucket due recipients by domain, then below round-robin one off
+	// each domain's bucket per round, so a single domain with a large
+	// backlog (throttled or not) can't crowd the rest out of this tick's
+	// maxWorkers budget.
+	byDomain := map[string][]*Recipient{}
+	var domains []string
+	for _, rcpt := range rcpts {
+		d := domainOf(rcpt)
+		if _, ok := byDomain[d]; !ok {
+			domains = append(domains, d)
+		}
+		byDomain[d] = append(byDomain[d], rcpt)
+	}
+
+	groups := map[string][]*Recipient{}
+	dispatched := 0
+	for dispatched < maxWorkers {
+		progressed := false
+		for _, d := range domains {
+			queue := byDomain[d]
+			if len(queue) == 0 {
+				continue
+			}
+			rcpt := queue[0]
+			byDomain[d] = queue[1:]
+			progressed = true
+
+			if !q.inFlight.tryStart(rcpt.ID) {
+				// Already being worked on from an earlier tick.
+				continue
+			}
+
+			isRemoteEmail := rcpt.Type == Recipient_EMAIL &&
+				!envelope.DomainIn(rcpt.Address, q.localDomains)
+
+			if !q.throttle.tryAcquire(d) {
+				// Over the domain's concurrency or rate limit for now;
+				// leave it pending and pick it up again on a later tick.
+				q.inFlight.finish(rcpt.ID)
+				continue
+			}
+
+			if canBatch && isRemoteEmail {
+				key := rcpt.ItemID + "\x00" + d
+				groups[key] = append(groups[key], rcpt)
+			} else {
+				rcpt, d := rcpt, d
+				q.dispatch(func() { q.dispatchOne(rcpt, d) })
+			}
+			dispatched++
+
+			if dispatched >= maxWorkers {
+				break
+			}
+		}
+		if !progressed {
+			break
+		}
+	}
+
+	for _, group := range groups {
+		group := group
+		domain := domainOf(group[0])
+		if len(group) == 1 {
+			q.dispatch(func() { q.dispatchOne(group[0], domain) })
+			continue
+		}
+		q.dispatch(func() { q.dispatchBatch(batchC, group, domain) })
+	}
+}
+
+// domainOf returns the destination domain a recipient is throttled by,
+// or "" if the recipient isn't subject to domain throttling (e.g. a
+// pipe recipient).
+func domainOf(rcpt *Recipient) string {
+	if rcpt.Type != Recipient_EMAIL {
+		return ""
+	}
+	return envelope.DomainOf(rcpt.Address)
+}
+
+// dispatchOne loads the item owning rcpt, attempts delivery, and
+// reschedules or finalizes as needed.
+func (q *Queue) dispatchOne(rcpt *Recipient, domain string) {
+	defer q.throttle.release(domain)
+	defer q.inFlight.finish(rcpt.ID)
+
+	item, err := q.store.LoadItem(rcpt.ItemID)
+	if err != nil {
+		log.Errorf("scheduler: error loading item %q: %v", rcpt.ItemID, err)
+		return
+	}
+
+	tr := trace.New("Queue.Dispatch", item.ID)
+	defer tr.Finish()
+
+	if time.Since(item.CreatedAt) >= q.retry.get(domain).MaxLifetime {
+		q.finalize(tr, item, true)
+		return
+	}
+
+	item.sendOneRcpt(tr, q, rcpt)
+	q.checkFinalize(tr, item)
+}
+
+// checkFinalize finalizes item (sending a DSN if warranted, and removing
+// it from the queue) once every recipient is no longer pending.
+func (q *Queue) checkFinalize(tr *trace.Trace, item *Item) {
+	q.finalize(tr, item, false)
+}
+
+// finalize attempts to atomically claim item and remove it from the
+// queue, sending a DSN if warranted. Unless force is set, it's a no-op
+// while any recipient is still pending.
+//
+// The claim (check pending==0, then delete) happens in a single store
+// transaction (see Store.ClaimFinalize), so when several goroutines are
+// delivering to different recipients of the same item concurrently (no
+// in-tree courier implements BatchCourier, so siblings are normally
+// dispatched one goroutine per recipient), only the one that observes
+// the last recipient settle actually claims the item and sends its DSN -
+// the rest see ok == false and do nothing, instead of every one of them
+// finalizing (and bouncing) the item.
+func (q *Queue) finalize(tr *trace.Trace, item *Item, force bool) {
+	full, ok, err := q.store.ClaimFinalize(item.ID, force)
+	if err != nil {
+		log.Errorf("scheduler: error finalizing %q: %v", item.ID, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if full.From != "<>" {
+		sendDSN(tr, q, full)
+	}
+
+	tr.Printf("all done")
+	maillog.QueueLoop(full.ID, full.From, 0)
+}
+
+// sendOneRcpt attempts delivery to a single recipient, and updates its
+// state in the store accordingly.
+func (item *Item) sendOneRcpt(tr *trace.Trace, q *Queue, rcpt *Recipient) {
+	key := sendKey(item.From, []string{rcpt.Address}, item.Data)
+	if q.sendRecorder.Seen(key) {
+		// We already delivered to this recipient very recently; most
+		// likely we crashed after the courier accepted the message but
+		// before we persisted Recipient_SENT. Don't deliver it again.
+		tr.Printf("%s already sent recently, not re-delivering", rcpt.Address)
+		item.recordResult(tr, q, rcpt, nil, false)
+		return
+	}
+
+	tr.Debugf("%s sending", rcpt.Address)
+	err, permanent := item.deliver(q, rcpt)
+	if err == nil {
+		q.sendRecorder.Record(key, item.ID)
+	}
+	item.recordResult(tr, q, rcpt, err, permanent)
+}
+
+// recordResult applies the outcome of a delivery attempt (however it was
+// made - directly, or as part of a batch) to rcpt, and persists it.
+func (item *Item) recordResult(tr *trace.Trace, q *Queue, rcpt *Recipient, err error, permanent bool) {
+	to := rcpt.Address
+	rcpt.Attempts++
+	rcpt.LastAttempt = time.Now()
+
+	if err != nil {
+		rcpt.LastFailureMessage = err.Error()
+		rcpt.LastError = err.Error()
+		if permanent {
+			tr.Errorf("%s permanent error: %v", to, err)
+			maillog.SendAttempt(item.ID, item.From, to, err, true)
+			rcpt.Status = Recipient_FAILED
+		} else {
+			tr.Printf("%s temporary error: %v", to, err)
+			maillog.SendAttempt(item.ID, item.From, to, err, false)
+			delay := q.retry.get(domainOf(rcpt)).nextDelay(rcpt.Attempts)
+			rcpt.NextAttempt = time.Now().Add(delay)
+			maillog.QueueLoop(item.ID, item.From, delay)
+		}
+	} else {
+		tr.Printf("%s sent", to)
+		maillog.SendAttempt(item.ID, item.From, to, nil, false)
+		rcpt.Status = Recipient_SENT
+	}
+
+	if err := q.store.UpdateRecipient(rcpt); err != nil {
+		tr.Errorf("failed to write: %v", err)
+	}
+
+	if item.From == "<>" {
+		// Never generate DSNs for DSNs.
+		return
+	}
+	switch {
+	case rcpt.Status == Recipient_SENT && rcpt.Notify.has(Recipient_NotifySuccess):
+		sendSuccessDSN(tr, q, item, rcpt)
+	case rcpt.Status == Recipient_PENDING:
+		maybeSendDelayDSN(tr, q, item, rcpt)
+	}
+}
+
+// ItemInfo is a summary of an item, for admin listing purposes.
+type ItemInfo struct {
+	ID        string
+	From      string
+	CreatedAt time.Time
+	Pending   int
+	Sent      int
+	Failed    int
+}
+
+// List returns a summary of every item currently in the queue.
+func (q *Queue) List() ([]ItemInfo, error) {
+	items, err := q.store.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]ItemInfo, 0, len(items))
+	for _, item := range items {
+		infos = append(infos, ItemInfo{
+			ID:        item.ID,
+			From:      item.From,
+			CreatedAt: item.CreatedAt,
+			Pending:   item.countRcpt(Recipient_PENDING),
+			Sent:      item.countRcpt(Recipient_SENT),
+			Failed:    item.countRcpt(Recipient_FAILED),
+		})
+	}
+	return infos, nil
+}
+
+// Inspect returns the full item (including all its recipients) for the
+// given ID, for admin debugging.
+func (q *Queue) Inspect(id string) (*Item, error) {
+	return q.store.LoadItem(id)
+}
+
+// Kick forces every pending recipient of the given item to become due
+// immediately, instead of waiting for its next scheduled attempt.
+func (q *Queue) Kick(id string) error {
+	return q.store.UpdateAllRecipients(id, func(rcpt *Recipient) {
+		if rcpt.Status == Recipient_PENDING {
+			rcpt.NextAttempt = time.Now()
+		}
+	})
+}
+
+// Hold pushes out every pending recipient's next attempt far into the
+// future, effectively pausing delivery for the item until Kick is
+// called.
+func (q *Queue) Hold(id string) error {
+	far := time.Now().Add(100 * 365 * 24 * time.Hour)
+	return q.store.UpdateAllRecipients(id, func(rcpt *Recipient) {
+		if rcpt.Status == Recipient_PENDING {
+			rcpt.NextAttempt = far
+		}
+	})
+}
+
+// Drop removes an item from the queue outright, regardless of its
+// recipients' status.
+func (q *Queue) Drop(id string) error {
+	return q.store.RemoveItem(id)
+}
@@ -0,0 +1,202 @@
+package queue
+
+// SendRecorder deduplicates recently-sent (from, recipients, message)
+// tuples for a configurable window, so that:
+//
+//   - A flaky client that resubmits the exact same message twice (e.g.
+//     after not seeing our response in time) doesn't get it queued, and
+//     eventually delivered, twice.
+//   - A crash between a courier reporting successful delivery and us
+//     persisting Recipient_SENT doesn't cause the recipient to be
+//     redelivered to on restart.
+//
+// Entries are kept in memory for fast lookups, and mirrored to the store
+// so they survive a restart within the window; expired entries are
+// dropped from both periodically.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/log"
+)
+
+// sendRecordWindow is how long we remember a send by default.
+const sendRecordWindow = 30 * time.Minute
+
+// sendRecordSweep is how often expired entries are purged.
+const sendRecordSweep = 5 * time.Minute
+
+// sendRecord is the on-disk representation of a remembered send.
+type sendRecord struct {
+	Key     string    `bstore:"primary"`
+	ItemID  string
+	Expires time.Time `bstore:"index"`
+}
+
+// sendEntry is a single in-memory SendRecorder entry.
+type sendEntry struct {
+	itemID  string
+	expires time.Time
+}
+
+// SendRecorder is an in-memory, store-backed cache of recently-sent
+// (from, recipients, message) tuples.
+type SendRecorder struct {
+	store  *Store
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]sendEntry
+}
+
+// newSendRecorder creates a SendRecorder, pre-loading it with whatever
+// unexpired records are already in store (left over from before a
+// restart).
+func newSendRecorder(store *Store, window time.Duration) (*SendRecorder, error) {
+	r := &SendRecorder{
+		store:   store,
+		window:  window,
+		entries: map[string]sendEntry{},
+	}
+
+	records, err := store.LoadSendRecords()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, rec := range records {
+		if rec.Expires.After(now) {
+			r.entries[rec.Key] = sendEntry{itemID: rec.ItemID, expires: rec.Expires}
+		}
+	}
+	return r, nil
+}
+
+// Seen reports whether key was recorded, and hasn't expired yet.
+func (r *SendRecorder) Seen(key string) bool {
+	_, ok := r.lookup(key)
+	return ok
+}
+
+// Lookup returns the ID of the item that was queued or delivered for
+// key, if it was recorded and hasn't expired yet. Put uses this to
+// return the same ID for a duplicate submission, instead of an error
+// the caller would otherwise have no choice but to report as a failure.
+func (r *SendRecorder) Lookup(key string) (itemID string, ok bool) {
+	return r.lookup(key)
+}
+
+func (r *SendRecorder) lookup(key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(r.entries, key)
+		return "", false
+	}
+	return entry.itemID, true
+}
+
+// Record marks key as sent for itemID, starting a fresh window from now.
+func (r *SendRecorder) Record(key, itemID string) {
+	expires := time.Now().Add(r.window)
+
+	r.mu.Lock()
+	r.entries[key] = sendEntry{itemID: itemID, expires: expires}
+	r.mu.Unlock()
+
+	if err := r.store.SaveSendRecord(key, itemID, expires); err != nil {
+		log.Errorf("sendrecorder: failed to persist record: %v", err)
+	}
+}
+
+// expire drops entries (in memory and in the store) that have expired.
+func (r *SendRecorder) expire() {
+	now := time.Now()
+
+	r.mu.Lock()
+	for key, entry := range r.entries {
+		if now.After(entry.expires) {
+			delete(r.entries, key)
+		}
+	}
+	r.mu.Unlock()
+
+	if err := r.store.PurgeExpiredSendRecords(now); err != nil {
+		log.Errorf("sendrecorder: failed to purge expired records: %v", err)
+	}
+}
+
+// sweep periodically expires old entries, until stop is closed.
+func (r *SendRecorder) sweep(stop chan struct{}) {
+	ticker := time.NewTicker(sendRecordSweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.expire()
+		}
+	}
+}
+
+// sendKey computes the dedup key for a (from, recipients, message)
+// tuple: the envelope sender, the sorted set of recipients, the
+// message's Message-Id header if it has one, and the message body.
+//
+// The body is always hashed in, even when a Message-Id is present: an
+// earlier version of this function used the Message-Id alone when
+// available, on the theory that a client resubmitting the exact same
+// message would keep it stable. But a client that reuses (or forges) a
+// Message-Id across genuinely different content - or legitimately
+// resends the same list-mail with new content inside the dedup window -
+// would then collide with the earlier submission and have its message
+// silently dropped, with Put reporting success. Folding in the body
+// means only a true resend (same Message-Id *and* same body) dedupes.
+func sendKey(from string, rcpts []string, data []byte) string {
+	sorted := append([]string(nil), rcpts...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	h.Write([]byte(from))
+	h.Write([]byte{0})
+	for _, rcpt := range sorted {
+		h.Write([]byte(rcpt))
+		h.Write([]byte{0})
+	}
+	if id := messageIDOf(data); id != "" {
+		h.Write([]byte(id))
+		h.Write([]byte{0})
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// messageIDOf returns the value of the message's Message-Id header, or
+// "" if it doesn't have one.
+func messageIDOf(data []byte) string {
+	header := data
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		header = data[:i]
+	}
+
+	const prefix = "message-id:"
+	for _, line := range bytes.Split(header, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) > len(prefix) && bytes.EqualFold(line[:len(prefix)], []byte(prefix)) {
+			return string(bytes.TrimSpace(line[len(prefix):]))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package queue
+
+import "testing"
+
+func TestSendKeySameMessageIDDifferentBody(t *testing.T) {
+	from := "sender@example.com"
+	rcpts := []string{"rcpt@example.org"}
+	data1 := []byte("Message-Id: <reused@example.com>\r\n\r\nfirst body\r\n")
+	data2 := []byte("Message-Id: <reused@example.com>\r\n\r\nsecond body, not the same message\r\n")
+
+	if messageIDOf(data1) != messageIDOf(data2) {
+		t.Fatalf("test setup broken: expected equal Message-Ids")
+	}
+
+	k1 := sendKey(from, rcpts, data1)
+	k2 := sendKey(from, rcpts, data2)
+	if k1 == k2 {
+		t.Fatalf("sendKey collided for two different bodies sharing a Message-Id")
+	}
+}
+
+func TestSendKeySameMessageIDSameBody(t *testing.T) {
+	from := "sender@example.com"
+	rcpts := []string{"rcpt@example.org"}
+	data := []byte("Message-Id: <resend@example.com>\r\n\r\nsame body\r\n")
+
+	if sendKey(from, rcpts, data) != sendKey(from, append([]string(nil), rcpts...), data) {
+		t.Fatalf("sendKey isn't stable for identical (from, rcpts, data)")
+	}
+}
+
+func TestSendKeyRecipientOrderDoesNotMatter(t *testing.T) {
+	from := "sender@example.com"
+	data := []byte("no message id here\r\n")
+
+	k1 := sendKey(from, []string{"a@example.org", "b@example.org"}, data)
+	k2 := sendKey(from, []string{"b@example.org", "a@example.org"}, data)
+	if k1 != k2 {
+		t.Fatalf("sendKey depends on recipient order")
+	}
+}
+
+func TestSendRecorderSeenAndRecord(t *testing.T) {
+	store, err := newStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newStore: %v", err)
+	}
+	defer store.Close()
+
+	r, err := newSendRecorder(store, sendRecordWindow)
+	if err != nil {
+		t.Fatalf("newSendRecorder: %v", err)
+	}
+
+	key := sendKey("from@example.com", []string{"to@example.org"}, []byte("hello"))
+	if r.Seen(key) {
+		t.Fatalf("Seen() true before Record()")
+	}
+	if _, ok := r.Lookup(key); ok {
+		t.Fatalf("Lookup() ok before Record()")
+	}
+
+	r.Record(key, "item1")
+
+	if !r.Seen(key) {
+		t.Fatalf("Seen() false after Record()")
+	}
+	if id, ok := r.Lookup(key); !ok || id != "item1" {
+		t.Fatalf("Lookup() = (%q, %v), want (\"item1\", true)", id, ok)
+	}
+
+	// A restart should pick up the unexpired record from the store.
+	r2, err := newSendRecorder(store, sendRecordWindow)
+	if err != nil {
+		t.Fatalf("newSendRecorder: %v", err)
+	}
+	if id, ok := r2.Lookup(key); !ok || id != "item1" {
+		t.Fatalf("Lookup() after reload = (%q, %v), want (\"item1\", true)", id, ok)
+	}
+}
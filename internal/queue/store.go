@@ -0,0 +1,287 @@
+package queue
+
+// This file implements the durable, transactional on-disk store for the
+// queue, backed by bstore. It replaces the previous scheme of one text
+// file per envelope (protobuf-encoded, written and read whole): items
+// and their recipients are now indexed records in a single database
+// file, which lets the scheduler (see scheduler.go) query for due work
+// directly instead of every item running its own send loop over an
+// in-memory map guarded by a global mutex.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mjl-/bstore"
+)
+
+// dbFileName is the name of the bstore database file within the queue
+// directory.
+const dbFileName = "queue.db"
+
+// Store is the durable backing store for a Queue. Item and Recipient
+// (see queue.go) are its two record types; Recipient rows reference
+// their owning Item via ItemID.
+type Store struct {
+	db *bstore.DB
+}
+
+// newStore opens (creating if needed) the queue's on-disk database.
+func newStore(path string) (*Store, error) {
+	db, err := bstore.Open(path+"/"+dbFileName, nil, Item{}, Recipient{}, sendRecord{})
+	if err != nil {
+		return nil, fmt.Errorf("opening queue store: %v", err)
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// InsertItem durably stores a newly-created item and its recipients in a
+// single transaction.
+func (s *Store) InsertItem(item *Item) error {
+	return s.db.Write(func(tx *bstore.Tx) error {
+		if err := tx.Insert(item); err != nil {
+			return err
+		}
+		for _, rcpt := range item.Rcpt {
+			rcpt.ItemID = item.ID
+			if err := tx.Insert(rcpt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateRecipient persists the current in-memory state of rcpt.
+func (s *Store) UpdateRecipient(rcpt *Recipient) error {
+	return s.db.Update(rcpt)
+}
+
+// RemoveItem deletes an item and all of its recipients.
+func (s *Store) RemoveItem(id string) error {
+	return s.db.Write(func(tx *bstore.Tx) error {
+		if err := tx.Delete(&Item{ID: id}); err != nil && err != bstore.ErrAbsent {
+			return err
+		}
+		rs, err := bstore.QueryTx[Recipient](tx).FilterNonzero(
+			Recipient{ItemID: id}).List()
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if err := tx.Delete(&r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Len returns the number of items in the queue.
+func (s *Store) Len() (int, error) {
+	return bstore.QueryDB[Item](s.db).Count()
+}
+
+// OldestCreatedAt returns the CreatedAt of the oldest item in the queue,
+// via the indexed CreatedAt column, without loading every item. ok is
+// false if the queue is empty.
+func (s *Store) OldestCreatedAt() (oldest time.Time, ok bool, err error) {
+	item, err := bstore.QueryDB[Item](s.db).SortAsc("CreatedAt").Limit(1).Get()
+	if err == bstore.ErrAbsent {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return item.CreatedAt, true, nil
+}
+
+// LoadAll loads every item, with its recipients, from the store. Used on
+// startup to drop items with nothing left to deliver, and for admin
+// listing and dumps; the scheduler queries DueRecipients instead.
+func (s *Store) LoadAll() ([]*Item, error) {
+	items, err := bstore.QueryDB[Item](s.db).List()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Item, 0, len(items))
+	for i := range items {
+		item := &items[i]
+		rcpts, err := bstore.QueryDB[Recipient](s.db).FilterNonzero(
+			Recipient{ItemID: item.ID}).List()
+		if err != nil {
+			return nil, err
+		}
+		for j := range rcpts {
+			item.Rcpt = append(item.Rcpt, &rcpts[j])
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// LoadItem loads a single item, with its recipients.
+func (s *Store) LoadItem(id string) (*Item, error) {
+	item, err := bstore.QueryDB[Item](s.db).FilterID(id).Get()
+	if err != nil {
+		return nil, err
+	}
+
+	rcpts, err := bstore.QueryDB[Recipient](s.db).FilterNonzero(
+		Recipient{ItemID: id}).List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range rcpts {
+		item.Rcpt = append(item.Rcpt, &rcpts[i])
+	}
+	return &item, nil
+}
+
+// ClaimFinalize atomically finalizes item, if it's eligible: unless
+// force is set, it only claims the item if it has no pending recipients
+// left. The check and the removal happen in a single transaction, so
+// when several goroutines race to finalize the same item (e.g. its last
+// two recipients are delivered to concurrently), exactly one of them
+// gets ok == true and a fully-loaded item to build a DSN from; the
+// others get ok == false and must not act on item again.
+func (s *Store) ClaimFinalize(itemID string, force bool) (item *Item, ok bool, err error) {
+	err = s.db.Write(func(tx *bstore.Tx) error {
+		it, ierr := bstore.QueryTx[Item](tx).FilterID(itemID).Get()
+		if ierr == bstore.ErrAbsent {
+			// Already claimed (and removed) by another goroutine.
+			return nil
+		}
+		if ierr != nil {
+			return ierr
+		}
+
+		rcpts, rerr := bstore.QueryTx[Recipient](tx).FilterNonzero(
+			Recipient{ItemID: itemID}).List()
+		if rerr != nil {
+			return rerr
+		}
+		if !force {
+			for i := range rcpts {
+				if rcpts[i].Status == Recipient_PENDING {
+					return nil
+				}
+			}
+		}
+
+		for i := range rcpts {
+			if derr := tx.Delete(&rcpts[i]); derr != nil {
+				return derr
+			}
+		}
+		if derr := tx.Delete(&it); derr != nil {
+			return derr
+		}
+
+		it.Rcpt = make([]*Recipient, len(rcpts))
+		for i := range rcpts {
+			it.Rcpt[i] = &rcpts[i]
+		}
+		item = &it
+		ok = true
+		return nil
+	})
+	return item, ok, err
+}
+
+// PendingCount returns how many recipients of the given item are still
+// pending.
+//
+// Status must be matched with FilterEqual, not FilterNonzero:
+// Recipient_PENDING is the zero value, and FilterNonzero drops
+// zero-valued fields from the filter entirely, which would count every
+// recipient of the item regardless of status.
+func (s *Store) PendingCount(itemID string) (int, error) {
+	return bstore.QueryDB[Recipient](s.db).
+		FilterNonzero(Recipient{ItemID: itemID}).
+		FilterEqual("Status", Recipient_PENDING).
+		Count()
+}
+
+// UpdateAllRecipients applies fn to every recipient of the given item,
+// and persists the result, all within a single transaction.
+func (s *Store) UpdateAllRecipients(itemID string, fn func(*Recipient)) error {
+	return s.db.Write(func(tx *bstore.Tx) error {
+		rcpts, err := bstore.QueryTx[Recipient](tx).FilterNonzero(
+			Recipient{ItemID: itemID}).List()
+		if err != nil {
+			return err
+		}
+		for i := range rcpts {
+			fn(&rcpts[i])
+			if err := tx.Update(&rcpts[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DueRecipients returns up to limit pending recipients whose NextAttempt
+// is not in the future, across the whole queue, oldest-due first, for
+// the scheduler to dispatch.
+//
+// Status must be matched with FilterEqual, not FilterNonzero:
+// Recipient_PENDING is the zero value, and FilterNonzero drops
+// zero-valued fields from the filter entirely, which would also match
+// already-SENT or -FAILED recipients here.
+//
+// Ordering by NextAttempt means limit consistently returns the
+// longest-waiting recipients rather than an arbitrary subset, but it
+// doesn't by itself stop one domain with a big backlog from filling the
+// whole page: dispatchDue additionally round-robins across domains once
+// it has the page, so a single saturated or throttled domain can't crowd
+// out every other domain's due mail for a tick (see chunk0-2).
+func (s *Store) DueRecipients(now time.Time, limit int) ([]*Recipient, error) {
+	rcpts, err := bstore.QueryDB[Recipient](s.db).
+		FilterEqual("Status", Recipient_PENDING).
+		FilterLessEqual("NextAttempt", now).
+		SortAsc("NextAttempt").
+		Limit(limit).
+		List()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Recipient, len(rcpts))
+	for i := range rcpts {
+		out[i] = &rcpts[i]
+	}
+	return out, nil
+}
+
+// LoadSendRecords loads every send record, expired ones included, for
+// SendRecorder to rebuild its in-memory cache from on startup (it skips
+// the expired ones).
+func (s *Store) LoadSendRecords() ([]sendRecord, error) {
+	return bstore.QueryDB[sendRecord](s.db).List()
+}
+
+// SaveSendRecord persists (or refreshes) a send record, so a restart
+// within the dedup window doesn't forget about it.
+func (s *Store) SaveSendRecord(key, itemID string, expires time.Time) error {
+	rec := sendRecord{Key: key, ItemID: itemID, Expires: expires}
+	err := s.db.Insert(&rec)
+	if err == bstore.ErrExist {
+		return s.db.Update(&rec)
+	}
+	return err
+}
+
+// PurgeExpiredSendRecords removes every send record that has expired as
+// of now.
+func (s *Store) PurgeExpiredSendRecords(now time.Time) error {
+	_, err := bstore.QueryDB[sendRecord](s.db).
+		FilterLessEqual("Expires", now).
+		Delete()
+	return err
+}
@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+// Regression test for a bug where DueRecipients used FilterNonzero with
+// Recipient_PENDING (the zero value), which bstore silently drops from
+// the filter, matching every recipient regardless of status.
+func TestDueRecipientsExcludesSent(t *testing.T) {
+	store, err := newStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newStore: %v", err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	item := &Item{
+		ID:   "item1",
+		From: "from@example.com",
+		Rcpt: []*Recipient{
+			{Address: "pending@example.com", Status: Recipient_PENDING, NextAttempt: now},
+			{Address: "sent@example.com", Status: Recipient_SENT, NextAttempt: now},
+			{Address: "failed@example.com", Status: Recipient_FAILED, NextAttempt: now},
+		},
+	}
+	if err := store.InsertItem(item); err != nil {
+		t.Fatalf("InsertItem: %v", err)
+	}
+
+	rcpts, err := store.DueRecipients(now.Add(time.Second), 10)
+	if err != nil {
+		t.Fatalf("DueRecipients: %v", err)
+	}
+	if len(rcpts) != 1 {
+		t.Fatalf("got %d due recipients, want 1 (%v)", len(rcpts), rcpts)
+	}
+	if rcpts[0].Address != "pending@example.com" {
+		t.Fatalf("got due recipient %q, want pending@example.com", rcpts[0].Address)
+	}
+
+	pending, err := store.PendingCount(item.ID)
+	if err != nil {
+		t.Fatalf("PendingCount: %v", err)
+	}
+	if pending != 1 {
+		t.Fatalf("got PendingCount %d, want 1", pending)
+	}
+}
+
+// Regression test for a race where two goroutines delivering to
+// different recipients of the same item could both observe
+// PendingCount() == 0 and both finalize it: ClaimFinalize must only let
+// one caller through, even if called after the item's already gone.
+func TestClaimFinalizeIsAtomic(t *testing.T) {
+	store, err := newStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newStore: %v", err)
+	}
+	defer store.Close()
+
+	item := &Item{
+		ID:   "item1",
+		From: "from@example.com",
+		Rcpt: []*Recipient{
+			{Address: "a@example.com", Status: Recipient_SENT},
+			{Address: "b@example.com", Status: Recipient_PENDING},
+		},
+	}
+	if err := store.InsertItem(item); err != nil {
+		t.Fatalf("InsertItem: %v", err)
+	}
+
+	if _, ok, err := store.ClaimFinalize(item.ID, false); err != nil {
+		t.Fatalf("ClaimFinalize: %v", err)
+	} else if ok {
+		t.Fatalf("ClaimFinalize claimed an item with a pending recipient")
+	}
+
+	for i := range item.Rcpt {
+		item.Rcpt[i].Status = Recipient_SENT
+		if err := store.UpdateRecipient(item.Rcpt[i]); err != nil {
+			t.Fatalf("UpdateRecipient: %v", err)
+		}
+	}
+
+	full, ok, err := store.ClaimFinalize(item.ID, false)
+	if err != nil {
+		t.Fatalf("ClaimFinalize: %v", err)
+	}
+	if !ok {
+		t.Fatalf("ClaimFinalize didn't claim a fully-settled item")
+	}
+	if len(full.Rcpt) != 2 {
+		t.Fatalf("got %d recipients on claimed item, want 2", len(full.Rcpt))
+	}
+
+	if _, ok, err := store.ClaimFinalize(item.ID, false); err != nil {
+		t.Fatalf("ClaimFinalize: %v", err)
+	} else if ok {
+		t.Fatalf("ClaimFinalize claimed an already-removed item a second time")
+	}
+}
@@ -0,0 +1,139 @@
+package queue
+
+// Per-domain concurrency and rate limiting for outgoing remote
+// deliveries. Without this, every pending recipient is dispatched in
+// parallel regardless of destination, which can hammer a single
+// receiver and trigger 4xx throttling from them.
+
+import (
+	"sync"
+	"time"
+)
+
+// DomainLimits configures how much concurrency and throughput we allow
+// towards a single destination domain.
+type DomainLimits struct {
+	// Maximum number of recipients being delivered to at once for this
+	// domain. 0 means unlimited.
+	//
+	// This is a per-recipient cap, not a per-connection one: a slot is
+	// reserved for each recipient dispatchDue hands off (see tryAcquire),
+	// before it's known whether several of them will end up sharing one
+	// connection via batching (see batch.go). With batching off (the
+	// common case today, since no in-tree courier implements
+	// BatchCourier) the two coincide; once a courier does implement
+	// batching, the slots in use will overstate actual connections, since
+	// a batch of N recipients holds N slots but only opens one.
+	MaxConcurrent int
+
+	// Maximum number of delivery attempts per hour to this domain.
+	// 0 means unlimited.
+	MaxPerHour int
+}
+
+// defaultDomainLimits is used for domains with no specific configuration.
+var defaultDomainLimits = DomainLimits{
+	MaxConcurrent: 0,
+	MaxPerHour:    0,
+}
+
+// throttle tracks in-flight deliveries and recent attempt timestamps per
+// destination domain, and decides whether a new attempt is allowed to
+// proceed right now.
+type throttle struct {
+	mu sync.Mutex
+
+	// Per-domain configuration, set via Queue.SetDomainLimits.
+	limits map[string]DomainLimits
+
+	// Number of deliveries currently in flight, per domain.
+	inFlight map[string]int
+
+	// Timestamps of attempts within the last hour, per domain, oldest
+	// first. Used to enforce MaxPerHour.
+	attempts map[string][]time.Time
+}
+
+func newThrottle() *throttle {
+	return &throttle{
+		limits:   map[string]DomainLimits{},
+		inFlight: map[string]int{},
+		attempts: map[string][]time.Time{},
+	}
+}
+
+// setLimits configures the limits to apply to the given domain.
+func (t *throttle) setLimits(domain string, limits DomainLimits) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limits[domain] = limits
+}
+
+func (t *throttle) limitsFor(domain string) DomainLimits {
+	if l, ok := t.limits[domain]; ok {
+		return l
+	}
+	return defaultDomainLimits
+}
+
+// tryAcquire reserves a delivery slot for domain, if the configured
+// concurrency and rate limits allow it right now. On success, the
+// caller must call release(domain) once the delivery attempt completes.
+//
+// One slot is reserved per recipient (see DomainLimits.MaxConcurrent),
+// regardless of whether the recipient ends up delivered on its own or as
+// part of a batch.
+func (t *throttle) tryAcquire(domain string) bool {
+	if domain == "" {
+		// Not a domain-limited delivery (e.g. a pipe recipient).
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	limits := t.limitsFor(domain)
+
+	if limits.MaxConcurrent > 0 && t.inFlight[domain] >= limits.MaxConcurrent {
+		return false
+	}
+
+	if limits.MaxPerHour > 0 {
+		cutoff := time.Now().Add(-1 * time.Hour)
+		kept := t.attempts[domain][:0]
+		for _, at := range t.attempts[domain] {
+			if at.After(cutoff) {
+				kept = append(kept, at)
+			}
+		}
+		t.attempts[domain] = kept
+		if len(kept) >= limits.MaxPerHour {
+			return false
+		}
+	}
+
+	t.inFlight[domain]++
+	t.attempts[domain] = append(t.attempts[domain], time.Now())
+	return true
+}
+
+// release frees up the concurrency slot reserved by a successful
+// tryAcquire call.
+func (t *throttle) release(domain string) {
+	if domain == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inFlight[domain] > 0 {
+		t.inFlight[domain]--
+	}
+}
+
+// SetDomainLimits configures the maximum concurrency and hourly delivery
+// rate for remote deliveries to the given domain. Domains with no
+// explicit configuration are unlimited, matching the previous behaviour.
+func (q *Queue) SetDomainLimits(domain string, limits DomainLimits) {
+	q.throttle.setLimits(domain, limits)
+}